@@ -27,6 +27,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/gravitational/session"
@@ -38,6 +39,8 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/mailgun/lemma/secret"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
 )
 
 // Authority implements minimal key-management facility for generating OpenSSH
@@ -46,13 +49,15 @@ type Authority interface {
 	GenerateKeyPair(passphrase string) (privKey []byte, pubKey []byte, err error)
 	GetNewKeyPairFromPool() (privKey []byte, pubKey []byte, err error)
 
-	// GenerateHostCert generates host certificate, it takes pkey as a signing
-	// private key (host certificate authority)
-	GenerateHostCert(pkey, key []byte, id, hostname, role string, ttl time.Duration) ([]byte, error)
+	// GenerateHostCert generates host certificate, it takes signer as the
+	// signing identity of the host certificate authority, obtained from a
+	// KeyManager rather than raw private key bytes
+	GenerateHostCert(signer ssh.Signer, key []byte, id, hostname, role string, ttl time.Duration) ([]byte, error)
 
-	// GenerateHostCert generates user certificate, it takes pkey as a signing
-	// private key (user certificate authority)
-	GenerateUserCert(pkey, key []byte, id, username string, ttl time.Duration) ([]byte, error)
+	// GenerateUserCert generates user certificate, it takes signer as the
+	// signing identity of the user certificate authority, obtained from a
+	// KeyManager rather than raw private key bytes
+	GenerateUserCert(signer ssh.Signer, key []byte, id, username string, ttl time.Duration) ([]byte, error)
 }
 
 type Session struct {
@@ -62,12 +67,13 @@ type Session struct {
 }
 
 func NewAuthServer(bk *encryptedbk.ReplicatedBackend, a Authority,
-	scrt secret.SecretService, hostname string) *AuthServer {
+	scrt secret.SecretService, hostname string, km KeyManager) *AuthServer {
 	as := AuthServer{}
 
 	as.bk = bk
 	as.Authority = a
 	as.scrt = scrt
+	as.km = &muxKeyManager{soft: &softKeyManager{}, other: km}
 
 	as.CAService = services.NewCAService(as.bk)
 	as.LockService = services.NewLockService(as.bk)
@@ -75,6 +81,9 @@ func NewAuthServer(bk *encryptedbk.ReplicatedBackend, a Authority,
 	as.ProvisioningService = services.NewProvisioningService(as.bk)
 	as.WebService = services.NewWebService(as.bk)
 	as.BkKeysService = services.NewBkKeysService(as.bk)
+	as.RevocationService = services.NewRevocationService(as.bk)
+	as.OIDCConnectorService = services.NewOIDCConnectorService(as.bk)
+	as.oidcPending = newOIDCPendingRequests()
 
 	as.Hostname = hostname
 	return &as
@@ -87,6 +96,10 @@ type AuthServer struct {
 	Authority
 	scrt     secret.SecretService
 	Hostname string
+	km       KeyManager
+	upstream UpstreamAuthority
+	// oidcPending tracks in-flight browser OIDC logins; see CreateOIDCAuthRequest.
+	oidcPending *oidcPendingRequests
 
 	*services.CAService
 	*services.LockService
@@ -94,69 +107,186 @@ type AuthServer struct {
 	*services.ProvisioningService
 	*services.WebService
 	*services.BkKeysService
+	*services.RevocationService
+	*services.OIDCConnectorService
 }
 
-// ResetHostCertificateAuthority generates host certificate authority and updates the backend
-func (s *AuthServer) ResetHostCertificateAuthority(pass string) error {
-	priv, pub, err := s.Authority.GenerateKeyPair(pass)
+// ResetHostCertificateAuthority generates a new host certificate authority
+// and updates the backend. keyURI selects where the new signing key lives:
+// empty or "softkey:" generates a local key pair; any other scheme (e.g.
+// "pkcs11:...") resolves via KeyManager, and only its public key is persisted.
+func (s *AuthServer) ResetHostCertificateAuthority(keyURI string) error {
+	ca, err := s.newCertificateAuthority(services.HostCert, keyURI)
 	if err != nil {
-		return err
+		return trace.Wrap(err)
 	}
-	return s.CAService.UpsertHostCertificateAuthority(
-		services.LocalCertificateAuthority{
-			CertificateAuthority: services.CertificateAuthority{
-				Type:       services.HostCert,
-				DomainName: s.Hostname,
-				PublicKey:  pub,
-				ID:         "local",
-			},
-			PrivateKey: priv},
-	)
+	return s.CAService.UpsertHostCertificateAuthority(*ca)
 }
 
-// ResetHostCertificateAuthority generates user certificate authority and updates the backend
-func (s *AuthServer) ResetUserCertificateAuthority(pass string) error {
-	priv, pub, err := s.Authority.GenerateKeyPair(pass)
+// ResetUserCertificateAuthority generates a new user certificate authority
+// and updates the backend. See ResetHostCertificateAuthority for keyURI.
+func (s *AuthServer) ResetUserCertificateAuthority(keyURI string) error {
+	ca, err := s.newCertificateAuthority(services.UserCert, keyURI)
 	if err != nil {
-		return err
+		return trace.Wrap(err)
 	}
-	return s.CAService.UpsertUserCertificateAuthority(
-		services.LocalCertificateAuthority{
+	return s.CAService.UpsertUserCertificateAuthority(*ca)
+}
+
+// newCertificateAuthority never writes a KeyURI onto the embedded, public
+// CertificateAuthority: that substruct crosses the wire to nodes, so any key
+// material (including a softkey: URI, which embeds the raw private key) must
+// stay confined to LocalCertificateAuthority's own fields.
+func (s *AuthServer) newCertificateAuthority(caType services.CertType, keyURI string) (*services.LocalCertificateAuthority, error) {
+	scheme := KeyURIScheme(keyURI)
+	if scheme == "" || scheme == SoftKeyScheme {
+		passphrase := keyURI
+		if scheme == SoftKeyScheme {
+			passphrase = strings.TrimPrefix(keyURI, SoftKeyScheme+":")
+		}
+		priv, pub, err := s.Authority.GenerateKeyPair(passphrase)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &services.LocalCertificateAuthority{
 			CertificateAuthority: services.CertificateAuthority{
-				Type:       services.UserCert,
+				Type:       caType,
 				DomainName: s.Hostname,
 				PublicKey:  pub,
 				ID:         "local",
 			},
-			PrivateKey: priv},
-	)
+			PrivateKey: priv,
+		}, nil
+	}
+
+	signer, err := s.km.CreateSigner(keyURI)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &services.LocalCertificateAuthority{
+		CertificateAuthority: services.CertificateAuthority{
+			Type:       caType,
+			DomainName: s.Hostname,
+			PublicKey:  ssh.MarshalAuthorizedKey(signer.PublicKey()),
+			ID:         "local",
+		},
+		KeyURI: keyURI,
+	}, nil
 }
 
-// GenerateHostCert generates host certificate, it takes pkey as a signing
-// private key (host certificate authority)
+// signerFor resolves a stored certificate authority to the ssh.Signer that
+// should sign with it, routing through the KeyManager named by its KeyURI.
+// CAs written before this migration have no KeyURI and keep working via the
+// raw PrivateKey they already carry.
+func (s *AuthServer) signerFor(ca services.LocalCertificateAuthority) (ssh.Signer, error) {
+	uri := ca.KeyURI
+	if uri == "" {
+		uri = encodeSoftKeyURI(ca.PrivateKey)
+	}
+	signer, err := s.km.CreateSigner(uri)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return signer, nil
+}
+
+// SetUpstreamAuthority configures an upstream authority that this
+// AuthServer delegates host/user cert signing to instead of using its own
+// CA private key, so a leaf cluster doesn't need to hold root CA material.
+// hostCAPublicKey and userCAPublicKey are persisted into CAService as
+// trusted authorities (with no private key of their own) so that certs the
+// upstream signs still verify locally.
+func (s *AuthServer) SetUpstreamAuthority(ua UpstreamAuthority, hostCAPublicKey, userCAPublicKey []byte) error {
+	if err := s.CAService.UpsertHostCertificateAuthority(services.LocalCertificateAuthority{
+		CertificateAuthority: services.CertificateAuthority{
+			Type:       services.HostCert,
+			DomainName: s.Hostname,
+			PublicKey:  hostCAPublicKey,
+			ID:         "upstream",
+		},
+	}); err != nil {
+		return trace.Wrap(err)
+	}
+	if err := s.CAService.UpsertUserCertificateAuthority(services.LocalCertificateAuthority{
+		CertificateAuthority: services.CertificateAuthority{
+			Type:       services.UserCert,
+			DomainName: s.Hostname,
+			PublicKey:  userCAPublicKey,
+			ID:         "upstream",
+		},
+	}); err != nil {
+		return trace.Wrap(err)
+	}
+	// Only now that both trusted keys are durably persisted do we start
+	// delegating signing to ua; otherwise GenerateHostCert/GenerateUserCert
+	// could route to an upstream whose public key isn't verifiable locally.
+	s.upstream = ua
+	return nil
+}
+
+// GenerateHostCert generates a host certificate, signing it with the host
+// certificate authority's current signer, or delegating to an upstream
+// authority if one is configured.
 func (s *AuthServer) GenerateHostCert(
-	key []byte, id, hostname, role string,
-	ttl time.Duration) ([]byte, error) {
+	key []byte, id, hostname, role string, ttl time.Duration,
+	extensions, criticalOptions map[string]string) ([]byte, error) {
+
+	if s.upstream != nil {
+		return s.upstream.SignHostCert(CertSigningRequest{
+			PublicKey:       key,
+			ID:              id,
+			Principal:       hostname,
+			Role:            role,
+			TTL:             ttl,
+			Extensions:      extensions,
+			CriticalOptions: criticalOptions,
+		})
+	}
 
 	hk, err := s.CAService.GetHostPrivateCertificateAuthority()
 	if err != nil {
 		return nil, err
 	}
-	return s.Authority.GenerateHostCert(hk.PrivateKey, key, id, hostname, role, ttl)
+	signer, err := s.signerFor(hk)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return s.Authority.GenerateHostCert(signer, key, id, hostname, role, ttl)
 }
 
-// GenerateUserCert generates user certificate, it takes pkey as a signing
-// private key (user certificate authority)
+// GenerateUserCert generates a user certificate, signing it with the user
+// certificate authority's current signer, or delegating to an upstream
+// authority if one is configured.
 func (s *AuthServer) GenerateUserCert(
-	key []byte, id, username string, ttl time.Duration) ([]byte, error) {
+	key []byte, id, username string, ttl time.Duration,
+	extensions, criticalOptions map[string]string) ([]byte, error) {
+
+	if s.upstream != nil {
+		return s.upstream.SignUserCert(CertSigningRequest{
+			PublicKey:       key,
+			ID:              id,
+			Principal:       username,
+			TTL:             ttl,
+			Extensions:      extensions,
+			CriticalOptions: criticalOptions,
+		})
+	}
 
 	hk, err := s.CAService.GetUserPrivateCertificateAuthority()
 	if err != nil {
 		return nil, err
 	}
-	return s.Authority.GenerateUserCert(hk.PrivateKey, key, id, username, ttl)
+	signer, err := s.signerFor(hk)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return s.Authority.GenerateUserCert(signer, key, id, username, ttl)
 }
 
+// SignIn authenticates a user with a local username and password. This is
+// kept alongside CreateOIDCAuthRequest/ValidateOIDCAuthCallback for
+// clusters that don't federate to an identity provider, or for users of a
+// connector-backed cluster who still need a local fallback.
 func (s *AuthServer) SignIn(user string, password []byte) (*Session, error) {
 	if err := s.CheckPasswordWOToken(user, password); err != nil {
 		return nil, err
@@ -228,7 +358,7 @@ func (s *AuthServer) RegisterUsingToken(outputToken, nodename, role string) (key
 	}
 	fullHostName := fmt.Sprintf("%s.%s", nodename, s.Hostname)
 	hostID := fmt.Sprintf("%s_%s", nodename, role)
-	c, err := s.GenerateHostCert(pub, hostID, fullHostName, role, 0)
+	c, err := s.GenerateHostCert(pub, hostID, fullHostName, role, 0, nil, nil)
 	if err != nil {
 		log.Warningf("[AUTH] Node `%v` cannot join: cert generation error. %v", nodename, err)
 		return PackedKeys{}, trace.Wrap(err)
@@ -308,7 +438,11 @@ func (s *AuthServer) NewWebSession(user string) (*Session, error) {
 	if err != nil {
 		return nil, err
 	}
-	cert, err := s.Authority.GenerateUserCert(hk.PrivateKey, pub, user, user, WebSessionTTL)
+	signer, err := s.signerFor(hk)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	cert, err := s.Authority.GenerateUserCert(signer, pub, user, user, WebSessionTTL)
 	if err != nil {
 		return nil, err
 	}
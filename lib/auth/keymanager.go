@@ -0,0 +1,153 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"encoding/base64"
+	"net"
+	"strings"
+
+	"github.com/gravitational/trace"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh/agent"
+)
+
+// KeyManager resolves an opaque key URI to a crypto.Signer-backed
+// ssh.Signer, so CA private key material never has to pass through
+// AuthServer as raw bytes. Modeled on smallstep's kms.KeyManager.
+type KeyManager interface {
+	// CreateSigner returns the ssh.Signer identified by uri.
+	CreateSigner(uri string) (ssh.Signer, error)
+}
+
+// Recognized KeyManager URI schemes.
+const (
+	SoftKeyScheme  = "softkey"
+	PKCS11Scheme   = "pkcs11"
+	SSHAgentScheme = "sshagent"
+)
+
+// NewKeyManager returns the KeyManager responsible for URIs with the given
+// scheme. An empty scheme is treated as SoftKeyScheme for backward
+// compatibility with CAs created before this migration. PKCS11Scheme has no
+// KeyManager here: NewKeyManager returns an error for it.
+func NewKeyManager(scheme string) (KeyManager, error) {
+	switch scheme {
+	case "", SoftKeyScheme:
+		return &softKeyManager{}, nil
+	case SSHAgentScheme:
+		return &sshAgentKeyManager{}, nil
+	case PKCS11Scheme:
+		return nil, trace.Errorf("pkcs11 key manager is not yet implemented")
+	default:
+		return nil, trace.Errorf("unsupported key manager scheme: %v", scheme)
+	}
+}
+
+// KeyURIScheme returns the scheme portion of a KMS URI, e.g. "pkcs11" for
+// "pkcs11:token=ca;object=host-ca". Returns "" for a bare softkey blob.
+func KeyURIScheme(uri string) string {
+	idx := strings.Index(uri, ":")
+	if idx == -1 {
+		return ""
+	}
+	return uri[:idx]
+}
+
+// softKeyManager is the default KeyManager: it keeps today's behavior of
+// storing an OpenSSH-format private key directly, wrapped in a
+// "softkey:<base64>" URI so every CA, regardless of backend, is addressed
+// the same way.
+type softKeyManager struct{}
+
+func encodeSoftKeyURI(priv []byte) string {
+	return SoftKeyScheme + ":" + base64.StdEncoding.EncodeToString(priv)
+}
+
+func (m *softKeyManager) CreateSigner(uri string) (ssh.Signer, error) {
+	scheme := KeyURIScheme(uri)
+	var encoded string
+	if scheme == "" {
+		encoded = uri
+	} else {
+		encoded = strings.TrimPrefix(uri, scheme+":")
+	}
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signer, err := ssh.ParsePrivateKey(raw)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return signer, nil
+}
+
+// sshAgentKeyManager signs using a key already loaded into a running
+// ssh-agent, identified by "sshagent:<socket-path>#<public-key-fingerprint>".
+type sshAgentKeyManager struct{}
+
+func (m *sshAgentKeyManager) CreateSigner(uri string) (ssh.Signer, error) {
+	rest := strings.TrimPrefix(uri, SSHAgentScheme+":")
+	parts := strings.SplitN(rest, "#", 2)
+	socketPath := parts[0]
+	if socketPath == "" {
+		return nil, trace.Errorf("sshagent URI is missing a socket path: %v", uri)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	signers, err := agent.NewClient(conn).Signers()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(parts) < 2 {
+		if len(signers) != 1 {
+			return nil, trace.Errorf("sshagent URI %v does not select a key and agent holds %v keys", uri, len(signers))
+		}
+		return signers[0], nil
+	}
+	fingerprint := parts[1]
+	for _, signer := range signers {
+		if ssh.FingerprintSHA256(signer.PublicKey()) == fingerprint {
+			return signer, nil
+		}
+	}
+	return nil, trace.Errorf("no key with fingerprint %v loaded in agent at %v", fingerprint, socketPath)
+}
+
+// muxKeyManager dispatches by URI scheme, always routing softkey/bare URIs
+// to soft regardless of what other is configured for. This keeps legacy
+// softkey CAs working once an AuthServer is pointed at a non-default
+// KeyManager.
+type muxKeyManager struct {
+	soft  KeyManager
+	other KeyManager
+}
+
+func (m *muxKeyManager) CreateSigner(uri string) (ssh.Signer, error) {
+	scheme := KeyURIScheme(uri)
+	if scheme == "" || scheme == SoftKeyScheme {
+		return m.soft.CreateSigner(uri)
+	}
+	if m.other == nil {
+		return nil, trace.Errorf("no key manager configured for scheme %v", scheme)
+	}
+	return m.other.CreateSigner(uri)
+}
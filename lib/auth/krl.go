@@ -0,0 +1,137 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/trace"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// krlMagic is borrowed from OpenSSH's KRL magic string. The rest of the
+// layout below is Teleport's own, simplified format (no version/date/flags/
+// comment fields), so this is not parseable by ssh-keygen(1) or sshd(8) —
+// GenerateKRL/parseKRLKeyIDs are the only reader and writer.
+const krlMagic = "SSHKRL\n"
+
+// krlVersion is the wire format version produced by GenerateKRL.
+const krlVersion = 1
+
+// RevokeCert marks a previously issued host or user certificate as revoked.
+// ttl of 0 means the revocation is never purged.
+func (s *AuthServer) RevokeCert(certID string, caType services.CertType, reason string, ttl time.Duration) error {
+	if err := s.RevocationService.UpsertRevokedCert(caType, certID, reason, ttl); err != nil {
+		return trace.Wrap(err)
+	}
+	log.Infof("[AUTH] revoked %v cert %v: %v", caType, certID, reason)
+	return nil
+}
+
+// GenerateKRL builds a key revocation list covering every certificate
+// currently revoked for caType. See krlMagic for a note on the wire format.
+func (s *AuthServer) GenerateKRL(caType services.CertType) ([]byte, error) {
+	revoked, err := s.RevocationService.GetRevokedCerts(caType)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var ca services.CertificateAuthority
+	switch caType {
+	case services.HostCert:
+		hk, err := s.CAService.GetHostCertificateAuthority()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		ca = hk
+	case services.UserCert:
+		uk, err := s.CAService.GetUserCertificateAuthority()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		ca = uk
+	default:
+		return nil, trace.Errorf("unknown certificate authority type: %v", caType)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(krlMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(krlVersion))
+
+	// hash-of-CA section: lets a checker skip this KRL entirely when it
+	// isn't relevant to the CA that issued the certificate being checked.
+	caHash := sha256.Sum256(ca.PublicKey)
+	writeKRLSection(&buf, krlSectionCAHash, caHash[:])
+
+	// key-id section: revocations are tracked by the opaque cert ID passed
+	// to GenerateHostCert/GenerateUserCert.
+	ids := make([]string, 0, len(revoked))
+	for _, r := range revoked {
+		ids = append(ids, r.CertID)
+	}
+	writeKRLKeyIDSection(&buf, ids)
+
+	return buf.Bytes(), nil
+}
+
+// GetKRL returns the most recently generated KRL for caType and its
+// generation number, regenerating it if the revocation set has changed.
+func (s *AuthServer) GetKRL(caType services.CertType) (krl []byte, generation uint64, err error) {
+	gen, err := s.RevocationService.GetKRLGeneration(caType)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	cached, cachedGen, ok := s.RevocationService.GetCachedKRL(caType)
+	if ok && cachedGen == gen {
+		return cached, gen, nil
+	}
+	krl, err = s.GenerateKRL(caType)
+	if err != nil {
+		return nil, 0, trace.Wrap(err)
+	}
+	if err := s.RevocationService.SetCachedKRL(caType, krl, gen); err != nil {
+		log.Warningf("[AUTH] failed to cache KRL for %v: %v", caType, err)
+	}
+	return krl, gen, nil
+}
+
+const (
+	krlSectionCertificates = 1
+	krlSectionCAHash       = 3
+	krlSectionKeyID        = 4
+)
+
+func writeKRLSection(buf *bytes.Buffer, sectionType byte, data []byte) {
+	buf.WriteByte(sectionType)
+	binary.Write(buf, binary.BigEndian, uint32(len(data)))
+	buf.Write(data)
+}
+
+// writeKRLKeyIDSection writes a krlSectionKeyID section: each id as a
+// big-endian uint32 length followed by its bytes.
+func writeKRLKeyIDSection(buf *bytes.Buffer, ids []string) {
+	var section bytes.Buffer
+	for _, id := range ids {
+		binary.Write(&section, binary.BigEndian, uint32(len(id)))
+		section.WriteString(id)
+	}
+	writeKRLSection(buf, krlSectionKeyID, section.Bytes())
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestWriteKRLKeyIDSection(t *testing.T) {
+	var buf bytes.Buffer
+	writeKRLKeyIDSection(&buf, []string{"host1", "host2"})
+
+	out := buf.Bytes()
+	if out[0] != krlSectionKeyID {
+		t.Fatalf("expected section type %v, got %v", krlSectionKeyID, out[0])
+	}
+	sectionLen := binary.BigEndian.Uint32(out[1:5])
+	section := out[5 : 5+int(sectionLen)]
+
+	var ids []string
+	for len(section) > 0 {
+		idLen := binary.BigEndian.Uint32(section[:4])
+		section = section[4:]
+		ids = append(ids, string(section[:idLen]))
+		section = section[idLen:]
+	}
+	if len(ids) != 2 || ids[0] != "host1" || ids[1] != "host2" {
+		t.Fatalf("unexpected decoded ids: %v", ids)
+	}
+}
+
+func TestWriteKRLSection(t *testing.T) {
+	var buf bytes.Buffer
+	writeKRLSection(&buf, krlSectionCAHash, []byte("hash-bytes"))
+
+	out := buf.Bytes()
+	if out[0] != krlSectionCAHash {
+		t.Fatalf("expected section type %v, got %v", krlSectionCAHash, out[0])
+	}
+	sectionLen := binary.BigEndian.Uint32(out[1:5])
+	if int(sectionLen) != len("hash-bytes") {
+		t.Fatalf("expected length %v, got %v", len("hash-bytes"), sectionLen)
+	}
+	if string(out[5:]) != "hash-bytes" {
+		t.Fatalf("unexpected section body: %q", out[5:])
+	}
+}
@@ -0,0 +1,372 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+	"github.com/gravitational/trace"
+)
+
+// oidcStateTTL bounds how long a pending OIDC auth request stays valid
+// waiting for the identity provider to redirect back.
+const oidcStateTTL = 10 * time.Minute
+
+// oidcHTTPTimeout bounds calls to an identity provider's token endpoint, so
+// a slow or unreachable IdP fails a login instead of hanging the request.
+const oidcHTTPTimeout = 30 * time.Second
+
+var oidcHTTPClient = &http.Client{Timeout: oidcHTTPTimeout}
+
+// OIDCAuthRequest is a pending browser-based OIDC login, keyed by a random
+// state value so ValidateOIDCAuthCallback can find it again once the
+// identity provider redirects back to the proxy or tsh.
+type OIDCAuthRequest struct {
+	ConnectorID string
+	RedirectURL string
+	CreatedAt   time.Time
+}
+
+// oidcPendingRequests holds OIDCAuthRequests in memory, keyed by state.
+// AuthServer only needs to remember these for the few minutes a browser
+// redirect round trip takes, so unlike the rest of AuthServer's state they
+// don't need to live on the replicated backend.
+type oidcPendingRequests struct {
+	mu       sync.Mutex
+	requests map[string]OIDCAuthRequest
+}
+
+func newOIDCPendingRequests() *oidcPendingRequests {
+	return &oidcPendingRequests{requests: map[string]OIDCAuthRequest{}}
+}
+
+func (p *oidcPendingRequests) add(stateID string, req OIDCAuthRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, r := range p.requests {
+		if time.Since(r.CreatedAt) > oidcStateTTL {
+			delete(p.requests, id)
+		}
+	}
+	p.requests[stateID] = req
+}
+
+func (p *oidcPendingRequests) take(stateID string) (OIDCAuthRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	req, ok := p.requests[stateID]
+	if ok {
+		delete(p.requests, stateID)
+	}
+	if ok && time.Since(req.CreatedAt) > oidcStateTTL {
+		return OIDCAuthRequest{}, false
+	}
+	return req, ok
+}
+
+// CreateOIDCAuthRequest starts a browser-based OIDC login against
+// connectorID, returning the URL to send the user's browser to and the
+// state value the callback will carry back so ValidateOIDCAuthCallback can
+// find this request again.
+func (s *AuthServer) CreateOIDCAuthRequest(connectorID, redirectURL string) (authURL string, stateID string, err error) {
+	conn, err := s.OIDCConnectorService.GetOIDCConnector(connectorID)
+	if err != nil {
+		return "", "", trace.Wrap(err)
+	}
+	if !conn.AllowsRedirectURL(redirectURL) {
+		return "", "", trace.Errorf("redirect URL %v is not registered for connector %v", redirectURL, connectorID)
+	}
+	disc, err := fetchOIDCDiscovery(conn.IssuerURL)
+	if err != nil {
+		return "", "", trace.Wrap(err)
+	}
+
+	stateID, err = randomOIDCState()
+	if err != nil {
+		return "", "", trace.Wrap(err)
+	}
+	s.oidcPending.add(stateID, OIDCAuthRequest{
+		ConnectorID: connectorID,
+		RedirectURL: redirectURL,
+		CreatedAt:   time.Now(),
+	})
+
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", conn.ClientID)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("scope", strings.Join(append([]string{"openid"}, conn.Scopes...), " "))
+	v.Set("state", stateID)
+
+	return disc.AuthorizationEndpoint + "?" + v.Encode(), stateID, nil
+}
+
+// ValidateOIDCAuthCallback completes a pending OIDC login: it exchanges
+// code for tokens, maps the ID token's claims to a Teleport username and
+// SSH principals via the connector's claim mapping, and issues a
+// short-lived user cert and web session the same way SignIn does for
+// password logins.
+func (s *AuthServer) ValidateOIDCAuthCallback(stateID, code string) (*Session, error) {
+	pending, ok := s.oidcPending.take(stateID)
+	if !ok {
+		return nil, trace.Errorf("OIDC auth request %v not found or expired", stateID)
+	}
+	conn, err := s.OIDCConnectorService.GetOIDCConnector(pending.ConnectorID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	claims, err := exchangeOIDCCode(conn, pending.RedirectURL, code)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	username, principals, err := conn.MapClaims(claims)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(principals) > 0 && !stringInSlice(principals, username) {
+		return nil, trace.Errorf("mapped username %v is not among the principals %v claimed for it", username, principals)
+	}
+
+	sess, err := s.NewWebSession(username)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if err := s.UpsertWebSession(username, sess, WebSessionTTL); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return sess, nil
+}
+
+func randomOIDCState() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// exchangeOIDCCode trades an authorization code for tokens at the
+// connector's issuer and returns the ID token's verified claims.
+func exchangeOIDCCode(conn *services.OIDCConnector, redirectURL, code string) (map[string]interface{}, error) {
+	disc, err := fetchOIDCDiscovery(conn.IssuerURL)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURL)
+	v.Set("client_id", conn.ClientID)
+	v.Set("client_secret", conn.ClientSecret)
+
+	resp, err := oidcHTTPClient.PostForm(disc.TokenEndpoint, v)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.Errorf("OIDC token exchange failed: %v", resp.Status)
+	}
+
+	var tokenResp struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return verifyIDToken(tokenResp.IDToken, disc, conn)
+}
+
+// oidcDiscovery is the subset of an issuer's
+// /.well-known/openid-configuration document that the OIDC login flow needs.
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func fetchOIDCDiscovery(issuer string) (*oidcDiscovery, error) {
+	resp, err := oidcHTTPClient.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.Errorf("OIDC discovery at %v failed: %v", issuer, resp.Status)
+	}
+	var disc oidcDiscovery
+	if err := json.NewDecoder(resp.Body).Decode(&disc); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &disc, nil
+}
+
+// jwks is an issuer's JSON Web Key Set, as served at oidcDiscovery.JWKSURI.
+type jwks struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func fetchJWKS(jwksURI string) (*jwks, error) {
+	resp, err := oidcHTTPClient.Get(jwksURI)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.Errorf("fetching JWKS from %v failed: %v", jwksURI, resp.Status)
+	}
+	var set jwks
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &set, nil
+}
+
+// findRSAPublicKey picks the RSA key matching kid out of set, or the first
+// RSA key in set if the token's header carried no kid.
+func findRSAPublicKey(set *jwks, kid string) (*rsa.PublicKey, error) {
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		if kid != "" && k.Kid != kid {
+			continue
+		}
+		nBytes, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		eBytes, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(nBytes),
+			E: int(new(big.Int).SetBytes(eBytes).Int64()),
+		}, nil
+	}
+	return nil, trace.Errorf("no matching RSA key found in JWKS for kid %v", kid)
+}
+
+// verifyIDToken checks idToken's RS256 signature against disc's JWKS and
+// validates its iss/aud/exp claims before returning its claims.
+func verifyIDToken(idToken string, disc *oidcDiscovery, conn *services.OIDCConnector) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, trace.Errorf("malformed ID token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if header.Alg != "RS256" {
+		return nil, trace.Errorf("unsupported ID token signing algorithm: %v", header.Alg)
+	}
+
+	set, err := fetchJWKS(disc.JWKSURI)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	pub, err := findRSAPublicKey(set, header.Kid)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, trace.Errorf("ID token signature verification failed: %v", err)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	claims := map[string]interface{}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != conn.IssuerURL && iss != conn.IssuerURL+"/" {
+		return nil, trace.Errorf("ID token issuer %v does not match connector issuer %v", iss, conn.IssuerURL)
+	}
+	if !audienceContains(claims, conn.ClientID) {
+		return nil, trace.Errorf("ID token audience does not include client %v", conn.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, trace.Errorf("ID token is missing a valid exp claim")
+	}
+	if time.Now().After(time.Unix(int64(exp), 0)) {
+		return nil, trace.Errorf("ID token has expired")
+	}
+
+	return claims, nil
+}
+
+func audienceContains(claims map[string]interface{}, clientID string) bool {
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stringInSlice(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/lib/services"
+)
+
+func genTestRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey: %v", err)
+	}
+	return key
+}
+
+func signTestIDToken(t *testing.T, priv *rsa.PrivateKey, kid, alg string, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT", "kid": kid}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("marshal header: %v", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signedPart := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signedPart))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("sign: %v", err)
+	}
+	return signedPart + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func jwksServer(pub *rsa.PublicKey, kid string) *httptest.Server {
+	body := fmt.Sprintf(`{"keys":[{"kty":"RSA","kid":%q,"n":%q,"e":%q}]}`,
+		kid,
+		base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+	)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+}
+
+func TestVerifyIDTokenAcceptsValidToken(t *testing.T) {
+	priv := genTestRSAKey(t)
+	srv := jwksServer(&priv.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": conn.ClientID,
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+	token := signTestIDToken(t, priv, "key1", "RS256", claims)
+
+	got, err := verifyIDToken(token, disc, conn)
+	if err != nil {
+		t.Fatalf("verifyIDToken: %v", err)
+	}
+	if got["iss"] != conn.IssuerURL {
+		t.Fatalf("unexpected claims: %v", got)
+	}
+}
+
+func TestVerifyIDTokenRejectsBadSignature(t *testing.T) {
+	signingKey := genTestRSAKey(t)
+	otherKey := genTestRSAKey(t)
+	srv := jwksServer(&otherKey.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": conn.ClientID,
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+	token := signTestIDToken(t, signingKey, "key1", "RS256", claims)
+
+	if _, err := verifyIDToken(token, disc, conn); err == nil {
+		t.Fatalf("expected signature verification to fail")
+	}
+}
+
+func TestVerifyIDTokenRejectsWrongAudience(t *testing.T) {
+	priv := genTestRSAKey(t)
+	srv := jwksServer(&priv.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": "someone-else",
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+	token := signTestIDToken(t, priv, "key1", "RS256", claims)
+
+	if _, err := verifyIDToken(token, disc, conn); err == nil {
+		t.Fatalf("expected audience mismatch to be rejected")
+	}
+}
+
+func TestVerifyIDTokenRejectsMissingExp(t *testing.T) {
+	priv := genTestRSAKey(t)
+	srv := jwksServer(&priv.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": conn.ClientID,
+	}
+	token := signTestIDToken(t, priv, "key1", "RS256", claims)
+
+	if _, err := verifyIDToken(token, disc, conn); err == nil {
+		t.Fatalf("expected a missing exp claim to be rejected")
+	}
+}
+
+func TestVerifyIDTokenRejectsExpiredToken(t *testing.T) {
+	priv := genTestRSAKey(t)
+	srv := jwksServer(&priv.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": conn.ClientID,
+		"exp": float64(time.Now().Add(-time.Hour).Unix()),
+	}
+	token := signTestIDToken(t, priv, "key1", "RS256", claims)
+
+	if _, err := verifyIDToken(token, disc, conn); err == nil {
+		t.Fatalf("expected an expired token to be rejected")
+	}
+}
+
+func TestVerifyIDTokenRejectsUnsupportedAlg(t *testing.T) {
+	priv := genTestRSAKey(t)
+	srv := jwksServer(&priv.PublicKey, "key1")
+	defer srv.Close()
+
+	conn := &services.OIDCConnector{IssuerURL: "https://idp.example.com", ClientID: "client1"}
+	disc := &oidcDiscovery{JWKSURI: srv.URL}
+	claims := map[string]interface{}{
+		"iss": conn.IssuerURL,
+		"aud": conn.ClientID,
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}
+	token := signTestIDToken(t, priv, "key1", "none", claims)
+
+	if _, err := verifyIDToken(token, disc, conn); err == nil {
+		t.Fatalf("expected an unsupported alg to be rejected")
+	}
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// CertSigningRequest is what a leaf AuthServer sends an UpstreamAuthority
+// when it delegates signing instead of holding CA private material itself.
+type CertSigningRequest struct {
+	PublicKey []byte
+	ID        string
+	// Principal is the cert's hostname (host certs) or username (user certs).
+	Principal       string
+	Role            string
+	TTL             time.Duration
+	Extensions      map[string]string
+	CriticalOptions map[string]string
+}
+
+// UpstreamAuthority signs host and user certificates on behalf of a leaf
+// AuthServer that doesn't hold its own CA private key, so root CA material
+// only ever lives at the top of a cluster chain. Modeled on smallstep's
+// linkedca.
+type UpstreamAuthority interface {
+	SignHostCert(req CertSigningRequest) ([]byte, error)
+	SignUserCert(req CertSigningRequest) ([]byte, error)
+}
+
+// UpstreamPolicy bounds what an upstream authority will sign for a leaf
+// cluster: a TTL ceiling and a principal allowlist, checked before the
+// upstream ever touches its CA key.
+type UpstreamPolicy struct {
+	MaxTTL            time.Duration
+	AllowedPrincipals []string
+}
+
+func (p UpstreamPolicy) check(req CertSigningRequest) error {
+	if p.MaxTTL != 0 && req.TTL > p.MaxTTL {
+		return trace.Errorf("requested TTL %v exceeds upstream cap %v", req.TTL, p.MaxTTL)
+	}
+	if len(p.AllowedPrincipals) == 0 {
+		return nil
+	}
+	for _, allowed := range p.AllowedPrincipals {
+		if allowed == req.Principal {
+			return nil
+		}
+	}
+	return trace.Errorf("principal %v is not in the upstream allowlist", req.Principal)
+}
+
+// localUpstreamAuthority adapts an upstream AuthServer's own CA into an
+// UpstreamAuthority, enforcing policy before delegating to its normal
+// GenerateHostCert/GenerateUserCert.
+type localUpstreamAuthority struct {
+	authServer *AuthServer
+	policy     UpstreamPolicy
+}
+
+// NewLocalUpstreamAuthority wraps upstream as an UpstreamAuthority.
+func NewLocalUpstreamAuthority(upstream *AuthServer, policy UpstreamPolicy) UpstreamAuthority {
+	return &localUpstreamAuthority{authServer: upstream, policy: policy}
+}
+
+func (u *localUpstreamAuthority) SignHostCert(req CertSigningRequest) ([]byte, error) {
+	if err := u.policy.check(req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return u.authServer.GenerateHostCert(req.PublicKey, req.ID, req.Principal, req.Role, req.TTL, req.Extensions, req.CriticalOptions)
+}
+
+func (u *localUpstreamAuthority) SignUserCert(req CertSigningRequest) ([]byte, error) {
+	if err := u.policy.check(req); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return u.authServer.GenerateUserCert(req.PublicKey, req.ID, req.Principal, req.TTL, req.Extensions, req.CriticalOptions)
+}
+
+// remoteUpstreamAuthority delegates to a remote Teleport auth server's HTTP
+// API, reached over client (typically the reverse-tunnel-backed transport
+// AuthServer's auth.Client already uses).
+type remoteUpstreamAuthority struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewRemoteUpstreamAuthority returns an UpstreamAuthority reachable at
+// baseURL through client.
+func NewRemoteUpstreamAuthority(baseURL string, client *http.Client) UpstreamAuthority {
+	return &remoteUpstreamAuthority{baseURL: baseURL, client: client}
+}
+
+func (u *remoteUpstreamAuthority) SignHostCert(req CertSigningRequest) ([]byte, error) {
+	return u.sign("/v1/ca/host/sign", req)
+}
+
+func (u *remoteUpstreamAuthority) SignUserCert(req CertSigningRequest) ([]byte, error) {
+	return u.sign("/v1/ca/user/sign", req)
+}
+
+func (u *remoteUpstreamAuthority) sign(path string, req CertSigningRequest) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, err := u.client.Post(u.baseURL+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, trace.Errorf("upstream authority rejected signing request: %v", resp.Status)
+	}
+	var out struct {
+		Cert []byte `json:"cert"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return out.Cert, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reversetunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func buildTestKRL(ids []string) []byte {
+	var section bytes.Buffer
+	for _, id := range ids {
+		binary.Write(&section, binary.BigEndian, uint32(len(id)))
+		section.WriteString(id)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("SSHKRL\n")
+	binary.Write(&buf, binary.BigEndian, uint32(1))
+	buf.WriteByte(4) // krlSectionKeyID
+	binary.Write(&buf, binary.BigEndian, uint32(section.Len()))
+	buf.Write(section.Bytes())
+	return buf.Bytes()
+}
+
+func TestParseKRLKeyIDsRoundTrip(t *testing.T) {
+	ids, err := parseKRLKeyIDs(buildTestKRL([]string{"node1", "node2"}))
+	if err != nil {
+		t.Fatalf("parseKRLKeyIDs: %v", err)
+	}
+	if len(ids) != 2 || !ids["node1"] || !ids["node2"] {
+		t.Fatalf("unexpected ids: %v", ids)
+	}
+}
+
+func TestParseKRLKeyIDsEmpty(t *testing.T) {
+	ids, err := parseKRLKeyIDs(nil)
+	if err != nil {
+		t.Fatalf("parseKRLKeyIDs: %v", err)
+	}
+	if len(ids) != 0 {
+		t.Fatalf("expected no ids, got %v", ids)
+	}
+}
+
+func TestParseKRLKeyIDsRejectsUnrecognizedInput(t *testing.T) {
+	if _, err := parseKRLKeyIDs([]byte("not a krl")); err == nil {
+		t.Fatalf("expected an error for unrecognized input")
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reversetunnel
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/github.com/gravitational/trace"
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+)
+
+// quarantineThreshold is the number of channel-open failures since the last
+// heartbeat that take an agent connection out of a Picker's rotation.
+const quarantineThreshold = 3
+
+// agentConn wraps a single ssh.Conn dialed in by a tunnel agent, together
+// with the health signals a Picker uses to decide whether to route new
+// channels to it.
+type agentConn struct {
+	conn ssh.Conn
+
+	mu            sync.RWMutex
+	lastHeartbeat time.Time
+	latency       time.Duration
+	errorCount    int
+	quarantined   bool
+	outstanding   int64
+}
+
+func newAgentConn(c ssh.Conn) *agentConn {
+	return &agentConn{conn: c, lastHeartbeat: time.Now()}
+}
+
+// recordHeartbeat marks the connection alive and folds the interval since
+// its last heartbeat into an EWMA used as a latency proxy.
+func (a *agentConn) recordHeartbeat() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	interval := time.Since(a.lastHeartbeat)
+	if a.latency == 0 {
+		a.latency = interval
+	} else {
+		a.latency += (interval - a.latency) / 8
+	}
+	a.lastHeartbeat = time.Now()
+	a.errorCount = 0
+	a.quarantined = false
+}
+
+// recordError counts a channel-open failure against this connection;
+// quarantineThreshold failures since the last heartbeat take it out of
+// rotation until the next successful heartbeat clears it. A successful
+// channel open does not reset the count.
+func (a *agentConn) recordError() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.errorCount++
+	if a.errorCount >= quarantineThreshold {
+		a.quarantined = true
+	}
+}
+
+func (a *agentConn) isHealthy() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.quarantined {
+		return false
+	}
+	return time.Since(a.lastHeartbeat) <= 2*heartbeatPeriod
+}
+
+func (a *agentConn) getLatency() time.Duration {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.latency
+}
+
+func (a *agentConn) heartbeatTime() time.Time {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.lastHeartbeat
+}
+
+func (a *agentConn) status() TunnelStatus {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return TunnelStatus{
+		RemoteAddr:    a.conn.RemoteAddr().String(),
+		LastHeartbeat: a.lastHeartbeat,
+		LatencyMS:     a.latency.Nanoseconds() / int64(time.Millisecond),
+		ErrorCount:    a.errorCount,
+		Outstanding:   atomic.LoadInt64(&a.outstanding),
+		Quarantined:   a.quarantined,
+	}
+}
+
+// openChannel opens a new SSH channel on this connection, tracking it in
+// the outstanding-channel count the least-outstanding Picker relies on.
+func (a *agentConn) openChannel(channelType string, extra []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	atomic.AddInt64(&a.outstanding, 1)
+	ch, reqs, err := a.conn.OpenChannel(channelType, extra)
+	if err != nil {
+		atomic.AddInt64(&a.outstanding, -1)
+		a.recordError()
+		return nil, nil, err
+	}
+	return ch, reqs, nil
+}
+
+func (a *agentConn) channelClosed() {
+	atomic.AddInt64(&a.outstanding, -1)
+}
+
+// TunnelStatus is a point-in-time snapshot of one agent connection's
+// health, returned by RemoteSite.GetTunnels() for observability.
+type TunnelStatus struct {
+	RemoteAddr    string
+	LastHeartbeat time.Time
+	LatencyMS     int64
+	ErrorCount    int
+	Outstanding   int64
+	Quarantined   bool
+}
+
+// Picker selects a healthy connection from a site's pool of live agent
+// connections when opening a new tunnel channel.
+type Picker interface {
+	Pick(conns []*agentConn) (*agentConn, error)
+}
+
+// Picker strategy names accepted by NewPicker.
+const (
+	RoundRobin       = "round-robin"
+	LeastOutstanding = "least-outstanding"
+	LowestLatency    = "lowest-latency"
+)
+
+// NewPicker returns the Picker implementing the named strategy. An empty
+// strategy defaults to round-robin.
+func NewPicker(strategy string) (Picker, error) {
+	switch strategy {
+	case "", RoundRobin:
+		return &roundRobinPicker{}, nil
+	case LeastOutstanding:
+		return &leastOutstandingPicker{}, nil
+	case LowestLatency:
+		return &lowestLatencyPicker{}, nil
+	default:
+		return nil, trace.Errorf("unknown tunnel picker strategy: %v", strategy)
+	}
+}
+
+func healthyConns(conns []*agentConn) []*agentConn {
+	out := make([]*agentConn, 0, len(conns))
+	for _, c := range conns {
+		if c.isHealthy() {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+type roundRobinPicker struct {
+	mu   sync.Mutex
+	next int
+}
+
+func (p *roundRobinPicker) Pick(conns []*agentConn) (*agentConn, error) {
+	healthy := healthyConns(conns)
+	if len(healthy) == 0 {
+		return nil, trace.Errorf("no healthy tunnel connections")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := healthy[p.next%len(healthy)]
+	p.next++
+	return c, nil
+}
+
+type leastOutstandingPicker struct{}
+
+func (p *leastOutstandingPicker) Pick(conns []*agentConn) (*agentConn, error) {
+	healthy := healthyConns(conns)
+	if len(healthy) == 0 {
+		return nil, trace.Errorf("no healthy tunnel connections")
+	}
+	best := healthy[0]
+	for _, c := range healthy[1:] {
+		if atomic.LoadInt64(&c.outstanding) < atomic.LoadInt64(&best.outstanding) {
+			best = c
+		}
+	}
+	return best, nil
+}
+
+type lowestLatencyPicker struct{}
+
+func (p *lowestLatencyPicker) Pick(conns []*agentConn) (*agentConn, error) {
+	healthy := healthyConns(conns)
+	if len(healthy) == 0 {
+		return nil, trace.Errorf("no healthy tunnel connections")
+	}
+	// latency == 0 means no heartbeat has completed yet (a new or just
+	// reconnected agentConn), not an actual zero measurement; never let it
+	// beat a connection with a real one.
+	var best *agentConn
+	var bestLatency time.Duration
+	for _, c := range healthy {
+		l := c.getLatency()
+		if l == 0 {
+			continue
+		}
+		if best == nil || l < bestLatency {
+			best = c
+			bestLatency = l
+		}
+	}
+	if best == nil {
+		best = healthy[0]
+	}
+	return best, nil
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2015 Gravitational, Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package reversetunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gravitational/teleport/Godeps/_workspace/src/golang.org/x/crypto/ssh"
+)
+
+type fakeAddr struct{}
+
+func (fakeAddr) Network() string { return "tcp" }
+func (fakeAddr) String() string  { return "127.0.0.1:0" }
+
+type fakeConn struct{}
+
+func (fakeConn) User() string           { return "" }
+func (fakeConn) SessionID() []byte      { return nil }
+func (fakeConn) ClientVersion() []byte  { return nil }
+func (fakeConn) ServerVersion() []byte  { return nil }
+func (fakeConn) RemoteAddr() net.Addr   { return fakeAddr{} }
+func (fakeConn) LocalAddr() net.Addr    { return fakeAddr{} }
+func (fakeConn) Close() error           { return nil }
+func (fakeConn) Wait() error            { return nil }
+func (fakeConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+func (fakeConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, nil
+}
+
+func newTestConn() *agentConn {
+	return newAgentConn(fakeConn{})
+}
+
+func TestRoundRobinPickerAlternates(t *testing.T) {
+	conns := []*agentConn{newTestConn(), newTestConn()}
+	p := &roundRobinPicker{}
+	first, err := p.Pick(conns)
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	second, err := p.Pick(conns)
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	if first == second {
+		t.Fatalf("expected round-robin to alternate between connections")
+	}
+}
+
+func TestLeastOutstandingPickerPrefersFewerChannels(t *testing.T) {
+	busy, idle := newTestConn(), newTestConn()
+	busy.outstanding = 5
+	picked, err := (&leastOutstandingPicker{}).Pick([]*agentConn{busy, idle})
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	if picked != idle {
+		t.Fatalf("expected the connection with fewer outstanding channels to be picked")
+	}
+}
+
+func TestLowestLatencyPickerIgnoresUnmeasuredConns(t *testing.T) {
+	measured, unmeasured := newTestConn(), newTestConn()
+	measured.latency = 50 * time.Millisecond
+	picked, err := (&lowestLatencyPicker{}).Pick([]*agentConn{unmeasured, measured})
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	if picked != measured {
+		t.Fatalf("expected the measured connection to win over one with no heartbeat yet")
+	}
+}
+
+func TestLowestLatencyPickerFallsBackWhenNothingMeasured(t *testing.T) {
+	conns := []*agentConn{newTestConn(), newTestConn()}
+	picked, err := (&lowestLatencyPicker{}).Pick(conns)
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	if picked == nil {
+		t.Fatalf("expected a fallback pick when no connection has a latency measurement")
+	}
+}
+
+func TestPickersErrorWithNoHealthyConns(t *testing.T) {
+	stale := newTestConn()
+	stale.lastHeartbeat = time.Now().Add(-time.Hour)
+	pickers := []Picker{&roundRobinPicker{}, &leastOutstandingPicker{}, &lowestLatencyPicker{}}
+	for _, p := range pickers {
+		if _, err := p.Pick([]*agentConn{stale}); err == nil {
+			t.Fatalf("%T: expected an error when no healthy connections are available", p)
+		}
+	}
+}
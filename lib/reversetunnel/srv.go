@@ -16,6 +16,7 @@ limitations under the License.
 package reversetunnel
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"net/http"
@@ -44,6 +45,9 @@ type RemoteSite interface {
 	GetName() string
 	GetStatus() string
 	GetClient() *auth.Client
+	// GetTunnels returns the health of every live tunnel connection this
+	// site currently holds, for observability.
+	GetTunnels() []TunnelStatus
 }
 
 type Server interface {
@@ -63,6 +67,19 @@ type server struct {
 	srv         *sshutils.Server
 
 	sites []*remoteSite
+
+	// krl is the last key revocation list fetched from the auth server,
+	// indexed by the cert ID it revokes (see krlSectionKeyID in lib/auth).
+	krl map[string]bool
+	// krlGeneration is the generation number ap reported along with krl;
+	// sites send it to agents in heartbeat replies so they can tell whether
+	// their copy is stale.
+	krlGeneration uint64
+
+	// cachedTrustedCAKeys is the last successfully fetched set of trusted CA
+	// keys, served back out when ap is briefly unreachable (e.g. a leaf
+	// cluster's upstream authority hiccups) so isAuthority keeps working.
+	cachedTrustedCAKeys []ssh.PublicKey
 }
 
 // New returns an unstarted server
@@ -71,6 +88,7 @@ func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 	srv := &server{
 		sites: []*remoteSite{},
 		ap:    ap,
+		krl:   map[string]bool{},
 	}
 	s, err := sshutils.NewServer(
 		addr,
@@ -82,11 +100,43 @@ func NewServer(addr utils.NetAddr, hostSigners []ssh.Signer,
 	if err != nil {
 		return nil, err
 	}
-	srv.certChecker = ssh.CertChecker{IsAuthority: srv.isAuthority}
+	srv.certChecker = ssh.CertChecker{
+		IsAuthority: srv.isAuthority,
+		IsRevoked:   srv.isRevoked,
+	}
 	srv.srv = s
 	return srv, nil
 }
 
+// refreshKRL pulls the current host-cert KRL and its generation number from
+// the access point.
+func (s *server) refreshKRL() error {
+	krl, gen, err := s.ap.GetKRL(services.HostCert)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ids, err := parseKRLKeyIDs(krl)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.krl = ids
+	s.krlGeneration = gen
+	return nil
+}
+
+// isRevoked is consulted by certChecker before accepting an agent's host
+// certificate.
+func (s *server) isRevoked(cert *ssh.Certificate) bool {
+	if err := s.refreshKRL(); err != nil {
+		log.Errorf("failed to refresh KRL, using the last fetched KRL: %v", err)
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return s.krl[cert.KeyId]
+}
+
 func (s *server) Wait() {
 	s.srv.Wait()
 }
@@ -108,7 +158,7 @@ func (s *server) HandleNewChan(sconn *ssh.ServerConn, nch ssh.NewChannel) {
 	switch nch.ChannelType() {
 	case chanHeartbeat:
 		log.Infof("got heartbeat request from agent: %v", sconn)
-		site, err := s.upsertSite(sconn)
+		site, ac, err := s.upsertSite(sconn)
 		if err != nil {
 			log.Errorf("failed to upsert site: %v", err)
 			nch.Reject(ssh.ConnectionFailed, "failed to upsert site")
@@ -120,7 +170,7 @@ func (s *server) HandleNewChan(sconn *ssh.ServerConn, nch ssh.NewChannel) {
 			sconn.Close()
 			return
 		}
-		go site.handleHeartbeat(ch, req)
+		go site.handleHeartbeat(ac, ch, req)
 	}
 }
 
@@ -140,7 +190,29 @@ func (s *server) isAuthority(auth ssh.PublicKey) bool {
 	return false
 }
 
+// getTrustedCAKeys returns the current set of trusted CA keys, falling back
+// to the last known good set if ap is briefly unreachable - e.g. a leaf
+// cluster's upstream authority hiccups - rather than failing every auth
+// attempt in the meantime.
 func (s *server) getTrustedCAKeys() ([]ssh.PublicKey, error) {
+	keys, err := s.fetchTrustedCAKeys()
+	if err != nil {
+		s.RLock()
+		cached := s.cachedTrustedCAKeys
+		s.RUnlock()
+		if len(cached) != 0 {
+			log.Warningf("failed to refresh trusted CA keys, using last known good set: %v", err)
+			return cached, nil
+		}
+		return nil, err
+	}
+	s.Lock()
+	s.cachedTrustedCAKeys = keys
+	s.Unlock()
+	return keys, nil
+}
+
+func (s *server) fetchTrustedCAKeys() ([]ssh.PublicKey, error) {
 	out := []ssh.PublicKey{}
 	authKeys := [][]byte{}
 	key, err := s.ap.GetHostCertificateAuthority()
@@ -197,7 +269,9 @@ func (s *server) keyAuth(
 	return perms, nil
 }
 
-func (s *server) upsertSite(c ssh.Conn) (*remoteSite, error) {
+// upsertSite finds or creates the remoteSite for c's domain and adds c to
+// its pool of live agent connections.
+func (s *server) upsertSite(c ssh.Conn) (*remoteSite, *agentConn, error) {
 	s.Lock()
 	defer s.Unlock()
 
@@ -209,18 +283,15 @@ func (s *server) upsertSite(c ssh.Conn) (*remoteSite, error) {
 			break
 		}
 	}
-	if site != nil {
-		if err := site.init(c); err != nil {
-			return nil, err
-		}
-	} else {
-		site = &remoteSite{srv: s, domainName: c.User()}
-		if err := site.init(c); err != nil {
-			return nil, err
-		}
+	if site == nil {
+		site = &remoteSite{srv: s, domainName: domainName}
 		s.sites = append(s.sites, site)
 	}
-	return site, nil
+	ac, err := site.addConn(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return site, ac, nil
 }
 
 func (s *server) GetSites() []RemoteSite {
@@ -279,12 +350,21 @@ func (s *server) FindSimilarSite(domainName string) (RemoteSite, error) {
 	}
 }
 
+// remoteSite is a site reached over one or more tunnel connections dialed
+// in by agent processes sharing the same domain name. Connections are kept
+// in a pool rather than a single slot so an agent reconnecting (or running
+// several replicas for HA) doesn't drop channels that are already open on
+// the others.
 type remoteSite struct {
-	domainName       string
-	conn       ssh.Conn
-	lastActive time.Time
+	sync.RWMutex
+
+	domainName string
 	srv        *server
 	clt        *auth.Client
+
+	conns    []*agentConn
+	picker   Picker
+	reapOnce sync.Once
 }
 
 func (s *remoteSite) GetClient() *auth.Client {
@@ -299,43 +379,108 @@ func (s *remoteSite) String() string {
 	return fmt.Sprintf("remoteSite(%v)", s.domainName)
 }
 
-func (s *remoteSite) init(c ssh.Conn) error {
-	if s.conn != nil {
-		log.Infof("%v found site, closing previous connection", s)
-		s.conn.Close()
+// addConn registers a newly dialed-in agent connection with this site's
+// pool and lazily sets up the picker, access-point client and reaper that
+// are shared across the whole pool.
+func (s *remoteSite) addConn(c ssh.Conn) (*agentConn, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	ac := newAgentConn(c)
+	s.conns = append(s.conns, ac)
+	log.Infof("%v added tunnel connection %v, pool size now %v", s, c.RemoteAddr(), len(s.conns))
+
+	if s.picker == nil {
+		picker, err := NewPicker(RoundRobin)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		s.picker = picker
 	}
-	s.conn = c
-	tr := &http.Transport{
-		Dial: func(network, addr string) (net.Conn, error) {
-			ch, _, err := s.conn.OpenChannel(chanAccessPoint, nil)
-			if err != nil {
-				log.Errorf("remoteSite:authProxy %v", err)
-				return nil, err
+	if s.clt == nil {
+		tr := &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return s.dialAccessPoint()
+			},
+		}
+		clt, err := auth.NewClient(
+			"http://stub:0",
+			roundtrip.HTTPClient(&http.Client{
+				Transport: tr,
+			}))
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		s.clt = clt
+	}
+	s.reapOnce.Do(func() { go s.reapLoop() })
+	return ac, nil
+}
+
+// pick selects the connection to use for the next channel, per the site's
+// picker strategy.
+func (s *remoteSite) pick() (*agentConn, error) {
+	s.RLock()
+	defer s.RUnlock()
+	return s.picker.Pick(s.conns)
+}
+
+// reapLoop drops quarantined or long-silent connections from the pool on a
+// heartbeatPeriod cadence.
+func (s *remoteSite) reapLoop() {
+	ticker := time.NewTicker(heartbeatPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.Lock()
+		live := s.conns[:0]
+		for _, c := range s.conns {
+			if c.isHealthy() {
+				live = append(live, c)
+			} else {
+				log.Infof("%v reaping dead tunnel connection %v", s, c.conn.RemoteAddr())
+				c.conn.Close()
 			}
-			return newChConn(s.conn, ch), nil
-		},
+		}
+		s.conns = live
+		s.Unlock()
+	}
+}
+
+func (s *remoteSite) dialAccessPoint() (net.Conn, error) {
+	ac, err := s.pick()
+	if err != nil {
+		return nil, trace.Wrap(err)
 	}
-	clt, err := auth.NewClient(
-		"http://stub:0",
-		roundtrip.HTTPClient(&http.Client{
-			Transport: tr,
-		}))
+	ch, _, err := ac.openChannel(chanAccessPoint, nil)
 	if err != nil {
-		return err
+		log.Errorf("remoteSite:authProxy %v", err)
+		return nil, err
 	}
-	s.clt = clt
-	return nil
+	return newChConn(ac, ch), nil
 }
 
 func (s *remoteSite) GetStatus() string {
-	diff := time.Now().Sub(s.lastActive)
-	if diff > 2*heartbeatPeriod {
-		return RemoteSiteStatusOffline
+	s.RLock()
+	defer s.RUnlock()
+	for _, c := range s.conns {
+		if c.isHealthy() {
+			return RemoteSiteStatusOnline
+		}
 	}
-	return RemoteSiteStatusOnline
+	return RemoteSiteStatusOffline
 }
 
-func (s *remoteSite) handleHeartbeat(ch ssh.Channel, reqC <-chan *ssh.Request) {
+func (s *remoteSite) GetTunnels() []TunnelStatus {
+	s.RLock()
+	defer s.RUnlock()
+	out := make([]TunnelStatus, len(s.conns))
+	for i, c := range s.conns {
+		out[i] = c.status()
+	}
+	return out
+}
+
+func (s *remoteSite) handleHeartbeat(ac *agentConn, ch ssh.Channel, reqC <-chan *ssh.Request) {
 	go func() {
 		for {
 			req := <-reqC
@@ -344,21 +489,49 @@ func (s *remoteSite) handleHeartbeat(ch ssh.Channel, reqC <-chan *ssh.Request) {
 				return
 			}
 			log.Infof("%v -> ping", s)
-			s.lastActive = time.Now()
+			ac.recordHeartbeat()
+
+			s.srv.RLock()
+			gen := s.srv.krlGeneration
+			s.srv.RUnlock()
+			if req.WantReply {
+				req.Reply(true, encodeKRLGeneration(gen))
+			}
 		}
 	}()
 }
 
+// encodeKRLGeneration packs a KRL generation number into a heartbeat reply
+// payload so the agent on the other end knows whether to pull a fresh KRL
+// over chanAccessPoint.
+func encodeKRLGeneration(gen uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, gen)
+	return buf
+}
+
 func (s *remoteSite) GetName() string {
 	return s.domainName
 }
 
 func (s *remoteSite) GetLastConnected() time.Time {
-	return s.lastActive
+	s.RLock()
+	defer s.RUnlock()
+	var last time.Time
+	for _, c := range s.conns {
+		if hb := c.heartbeatTime(); hb.After(last) {
+			last = hb
+		}
+	}
+	return last
 }
 
 func (s *remoteSite) ConnectToServer(server, user string, auth []ssh.AuthMethod) (*ssh.Client, error) {
-	ch, _, err := s.conn.OpenChannel(chanTransport, nil)
+	ac, err := s.pick()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	ch, _, err := ac.openChannel(chanTransport, nil)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -370,7 +543,7 @@ func (s *remoteSite) ConnectToServer(server, user string, auth []ssh.AuthMethod)
 	if !dialed {
 		return nil, trace.Errorf("remote server %v is not available", server)
 	}
-	transportConn := newChConn(s.conn, ch)
+	transportConn := newChConn(ac, ch)
 	conn, chans, reqs, err := ssh.NewClientConn(
 		transportConn, server,
 		&ssh.ClientConfig{
@@ -403,7 +576,11 @@ func (s *remoteSite) DialServer(server string) (net.Conn, error) {
 		return nil, trace.Errorf("can't dial server %v, server is unknown", server)
 	}
 
-	ch, _, err := s.conn.OpenChannel(chanTransport, nil)
+	ac, err := s.pick()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	ch, _, err := ac.openChannel(chanTransport, nil)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -415,7 +592,7 @@ func (s *remoteSite) DialServer(server string) (net.Conn, error) {
 	if !dialed {
 		return nil, trace.Errorf("remote server %v is not available", server)
 	}
-	return newChConn(s.conn, ch), nil
+	return newChConn(ac, ch), nil
 }
 
 func (s *remoteSite) GetServers() ([]services.Server, error) {
@@ -425,12 +602,7 @@ func (s *remoteSite) GetServers() ([]services.Server, error) {
 func (s *remoteSite) handleAuthProxy(w http.ResponseWriter, r *http.Request) {
 	tr := &http.Transport{
 		Dial: func(network, addr string) (net.Conn, error) {
-			ch, _, err := s.conn.OpenChannel(chanAccessPoint, nil)
-			if err != nil {
-				log.Errorf("remoteSite:authProxy %v", err)
-				return nil, err
-			}
-			return newChConn(s.conn, ch), nil
+			return s.dialAccessPoint()
 		},
 	}
 
@@ -445,24 +617,29 @@ func (s *remoteSite) handleAuthProxy(w http.ResponseWriter, r *http.Request) {
 	fwd.ServeHTTP(w, r)
 }
 
-func newChConn(conn ssh.Conn, ch ssh.Channel) *chConn {
+func newChConn(ac *agentConn, ch ssh.Channel) *chConn {
 	c := &chConn{}
 	c.Channel = ch
-	c.conn = conn
+	c.ac = ac
 	return c
 }
 
 type chConn struct {
 	ssh.Channel
-	conn ssh.Conn
+	ac *agentConn
+}
+
+func (c *chConn) Close() error {
+	c.ac.channelClosed()
+	return c.Channel.Close()
 }
 
 func (c *chConn) LocalAddr() net.Addr {
-	return c.conn.LocalAddr()
+	return c.ac.conn.LocalAddr()
 }
 
 func (c *chConn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	return c.ac.conn.RemoteAddr()
 }
 
 func (c *chConn) SetDeadline(t time.Time) error {
@@ -477,4 +654,51 @@ func (c *chConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// parseKRLKeyIDs extracts the set of revoked cert IDs out of a KRL as
+// produced by lib/auth.GenerateKRL (not an OpenSSH-compatible KRL — see the
+// note on krlMagic there). Sections this server doesn't understand are
+// skipped.
+func parseKRLKeyIDs(krl []byte) (map[string]bool, error) {
+	const krlMagic = "SSHKRL\n"
+	const krlSectionKeyID = 4
+
+	ids := map[string]bool{}
+	if len(krl) == 0 {
+		return ids, nil
+	}
+	if len(krl) < len(krlMagic)+4 || string(krl[:len(krlMagic)]) != krlMagic {
+		return nil, trace.Errorf("not a recognized KRL")
+	}
+	buf := krl[len(krlMagic)+4:]
+	for len(buf) > 0 {
+		if len(buf) < 5 {
+			return nil, trace.Errorf("truncated KRL section header")
+		}
+		sectionType := buf[0]
+		sectionLen := binary.BigEndian.Uint32(buf[1:5])
+		buf = buf[5:]
+		if uint32(len(buf)) < sectionLen {
+			return nil, trace.Errorf("truncated KRL section body")
+		}
+		section := buf[:sectionLen]
+		buf = buf[sectionLen:]
+
+		if sectionType == krlSectionKeyID {
+			for len(section) > 0 {
+				if len(section) < 4 {
+					return nil, trace.Errorf("truncated KRL key-id entry")
+				}
+				idLen := binary.BigEndian.Uint32(section[:4])
+				section = section[4:]
+				if uint32(len(section)) < idLen {
+					return nil, trace.Errorf("truncated KRL key-id entry")
+				}
+				ids[string(section[:idLen])] = true
+				section = section[idLen:]
+			}
+		}
+	}
+	return ids, nil
+}
+
 const ExtHost = "host@teleport"